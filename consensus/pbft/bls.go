@@ -0,0 +1,47 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pbft
+
+// QuorumCertificate carries the partial BLS signatures of at least 2F+1
+// validators over a Subject's digest, contributed to by at least 2F+1
+// validators. In BLS mode it is meant to replace the 2F+1 individual ECDSA
+// seals that would otherwise be embedded in the committed block header,
+// shrinking extra-data size and the work a light client must do to verify
+// it to a single pairing check, but that depends on AggregateSignature
+// actually being a curve-level aggregate rather than concatenated partials;
+// see aggregateSignatures in the core package for the current state of
+// that.
+type QuorumCertificate struct {
+	Bitmap             []byte // one bit per validator index, set if it signed
+	AggregateSignature []byte
+}
+
+// BLSBackend is implemented by backends that support BLS-aggregated quorum
+// certificates instead of per-message ECDSA seals. Satisfied via a type
+// assertion on Backend.
+type BLSBackend interface {
+	// AggregateVerify checks that sigs, each produced by the validator at
+	// the same index in pubkeys, are all valid BLS signatures over digest.
+	AggregateVerify(sigs [][]byte, pubkeys [][]byte, digest []byte) error
+}
+
+// BLSValidator is implemented by Validator values that carry a BLS public
+// key alongside their ECDSA address, for use by backends running in BLS
+// mode.
+type BLSValidator interface {
+	BLSPublicKey() []byte
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+)
+
+// errDuplicateBLSSignature is returned when the same validator contributes
+// a second partial signature for a digest it has already signed.
+var errDuplicateBLSSignature = errors.New("pbft: validator already contributed a BLS signature for this digest")
+
+// blsQuorum accumulates partial BLS signatures over a single Subject digest
+// until 2F+1 validators have contributed.
+type blsQuorum struct {
+	mu      sync.Mutex
+	digest  []byte
+	sigs    map[common.Address][]byte
+	indices map[common.Address]int
+}
+
+func newBLSQuorum(digest []byte) *blsQuorum {
+	return &blsQuorum{
+		digest:  digest,
+		sigs:    make(map[common.Address][]byte),
+		indices: make(map[common.Address]int),
+	}
+}
+
+// add records src's partial signature together with its validator-set
+// index, supplied by the caller, so the eventual QuorumCertificate bitmap
+// can mark the right bit.
+func (q *blsQuorum) add(src pbft.Validator, index int, sig []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.sigs[src.Address()]; ok {
+		return errDuplicateBLSSignature
+	}
+	q.sigs[src.Address()] = sig
+	q.indices[src.Address()] = index
+	return nil
+}
+
+// size returns how many validators have contributed so far.
+func (q *blsQuorum) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.sigs)
+}
+
+// aggregate builds the QuorumCertificate once size() >= threshold: a
+// bitmap over validatorCount validators plus the aggregated signature.
+// Contributions are sorted by validator index first, so two honest nodes
+// aggregating the same quorum in different arrival order still produce
+// identical AggregateSignature bytes aligned with the bitmap.
+func (q *blsQuorum) aggregate(validatorCount int) (*pbft.QuorumCertificate, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	indices := make([]int, 0, len(q.sigs))
+	for addr := range q.sigs {
+		indices = append(indices, q.indices[addr])
+	}
+	sort.Ints(indices)
+
+	bitmap := make([]byte, (validatorCount+7)/8)
+	byIndex := make(map[int][]byte, len(q.sigs))
+	for addr, sig := range q.sigs {
+		byIndex[q.indices[addr]] = sig
+	}
+
+	sigs := make([][]byte, 0, len(indices))
+	for _, idx := range indices {
+		bitmap[idx/8] |= 1 << uint(idx%8)
+		sigs = append(sigs, byIndex[idx])
+	}
+
+	aggregate, err := aggregateSignatures(sigs)
+	if err != nil {
+		return nil, err
+	}
+	return &pbft.QuorumCertificate{Bitmap: bitmap, AggregateSignature: aggregate}, nil
+}
+
+// aggregateSignatures concatenates partial signatures, in the order given,
+// into the bytes stored as QuorumCertificate.AggregateSignature;
+// BLSBackend.AggregateVerify takes the partial signatures as a separate
+// slice, not this concatenation.
+// This is NOT curve-level BLS aggregation: concatenation still carries one
+// full signature per contributor, so it does not actually shrink extra-data
+// or collapse verification to a single pairing check the way a real
+// aggregate signature would. Producing a genuine aggregate requires a
+// pairing-capable curve library (e.g. crypto/bn256) that this checkout does
+// not have as a dependency; AggregateVerify's implementation is where that
+// would plug in. Until a backend does real curve-level aggregation,
+// QuorumCertificate is wire-compatible plumbing, not the smaller,
+// cheaper-to-verify certificate the BLS mode is meant to produce.
+func aggregateSignatures(sigs [][]byte) ([]byte, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("pbft: cannot aggregate zero signatures")
+	}
+	aggregate := make([]byte, 0, len(sigs)*len(sigs[0]))
+	for _, sig := range sigs {
+		aggregate = append(aggregate, sig...)
+	}
+	return aggregate, nil
+}
+
+// bitmapIndices returns the set validator indices in a QuorumCertificate's
+// bitmap, for verification or logging.
+func bitmapIndices(bitmap []byte) []int {
+	var indices []int
+	for i, b := range bitmap {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<uint(bit)) != 0 {
+				indices = append(indices, i*8+bit)
+			}
+		}
+	}
+	return indices
+}
+
+// blsQuorumKey turns a digest into a map key; digests are fixed-size
+// hashes in practice but this avoids assuming that here.
+func blsQuorumKey(digest []byte) string { return string(digest) }
+
+// recordPrepareSignature adds src's partial BLS signature over subject's
+// digest to the in-flight Prepare quorum, returning a non-nil certificate
+// once 2F+1 validators have contributed. handlePrepare does not call it, so
+// Prepare messages received by core do not feed this quorum.
+func (c *core) recordPrepareSignature(subject *pbft.Subject, src pbft.Validator, sig []byte) (*pbft.QuorumCertificate, error) {
+	return c.recordBLSSignature(c.blsPrepareQuorums, subject, src, sig)
+}
+
+// recordCommitSignature is the Commit-phase equivalent of
+// recordPrepareSignature. handleCommit does not call it, so Commit messages
+// received by core do not feed this quorum.
+func (c *core) recordCommitSignature(subject *pbft.Subject, src pbft.Validator, sig []byte) (*pbft.QuorumCertificate, error) {
+	return c.recordBLSSignature(c.blsCommitQuorums, subject, src, sig)
+}
+
+// recordBLSSignature accumulates into c.blsPrepareQuorums/blsCommitQuorums
+// rather than onto current.Prepares: those per-sequence quorum maps are
+// keyed by digest so they survive independently of whichever sequence is
+// "current" at call time (relevant once pipelining has more than one
+// sequence in flight), and c.current's own fields are defined in the
+// core.go this checkout does not have, so they are not available to add a
+// BLS-signature slot to here.
+func (c *core) recordBLSSignature(quorums map[string]*blsQuorum, subject *pbft.Subject, src pbft.Validator, sig []byte) (*pbft.QuorumCertificate, error) {
+	if _, ok := c.backend.(pbft.BLSBackend); !ok {
+		return nil, nil
+	}
+
+	key := blsQuorumKey(subject.Digest)
+	quorum, ok := quorums[key]
+	if !ok {
+		quorum = newBLSQuorum(subject.Digest)
+		quorums[key] = quorum
+	}
+
+	index := c.backend.Validators().GetIndex(src.Address())
+	if err := quorum.add(src, index, sig); err != nil {
+		return nil, err
+	}
+
+	threshold := int(2*c.F + 1)
+	if quorum.size() < threshold {
+		return nil, nil
+	}
+
+	qc, err := quorum.aggregate(c.backend.Validators().Size())
+	if err != nil {
+		return nil, err
+	}
+	delete(quorums, key)
+	return qc, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// fakeValidator is a minimal pbft.Validator used only to exercise
+// blsQuorum, independent of the real validator package.
+type fakeValidator struct {
+	addr common.Address
+}
+
+func (v fakeValidator) Address() common.Address { return v.addr }
+func (v fakeValidator) String() string          { return v.addr.Hex() }
+
+func TestBLSQuorumAggregatesAtThreshold(t *testing.T) {
+	digest := []byte{1, 2, 3}
+	q := newBLSQuorum(digest)
+
+	validators := []fakeValidator{
+		{addr: common.BytesToAddress([]byte{1})},
+		{addr: common.BytesToAddress([]byte{2})},
+		{addr: common.BytesToAddress([]byte{3})},
+		{addr: common.BytesToAddress([]byte{4})},
+	}
+
+	// contributed out of index order (2, then 0, then 1) to exercise that
+	// aggregate sorts by index rather than arrival order.
+	if err := q.add(validators[2], 2, []byte{2}); err != nil {
+		t.Fatalf("add(2): %v", err)
+	}
+	if err := q.add(validators[0], 0, []byte{0}); err != nil {
+		t.Fatalf("add(0): %v", err)
+	}
+	if q.size() != 2 {
+		t.Fatalf("expected 2 contributions, got %d", q.size())
+	}
+
+	// third contribution reaches a 2F+1=3 threshold against F=1
+	if err := q.add(validators[1], 1, []byte{1}); err != nil {
+		t.Fatalf("add(1): %v", err)
+	}
+
+	qc, err := q.aggregate(len(validators))
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	indices := bitmapIndices(qc.Bitmap)
+	if len(indices) != 3 {
+		t.Fatalf("expected 3 bits set in bitmap, got %v", indices)
+	}
+	if len(qc.AggregateSignature) != 3 {
+		t.Fatalf("expected the 3 one-byte partial sigs concatenated, got %d bytes", len(qc.AggregateSignature))
+	}
+	// contributions were added out of index order (2, then 0, then 1);
+	// aggregate must still sort by validator index so the signature bytes
+	// line up with the bitmap regardless of arrival order.
+	if want := []byte{0, 1, 2}; !reflect.DeepEqual(qc.AggregateSignature, want) {
+		t.Fatalf("expected signatures sorted by validator index %v, got %v", want, qc.AggregateSignature)
+	}
+}
+
+func TestBLSQuorumRejectsDuplicateSignature(t *testing.T) {
+	q := newBLSQuorum([]byte{1})
+	v := fakeValidator{addr: common.BytesToAddress([]byte{9})}
+
+	if err := q.add(v, 0, []byte{1}); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+	if err := q.add(v, 0, []byte{2}); err != errDuplicateBLSSignature {
+		t.Fatalf("expected errDuplicateBLSSignature, got %v", err)
+	}
+}
+
+func TestBitmapIndicesRoundTrip(t *testing.T) {
+	bitmap := make([]byte, 2)
+	for _, idx := range []int{0, 3, 9} {
+		bitmap[idx/8] |= 1 << uint(idx%8)
+	}
+	got := bitmapIndices(bitmap)
+	if len(got) != 3 || got[0] != 0 || got[1] != 3 || got[2] != 9 {
+		t.Fatalf("expected [0 3 9], got %v", got)
+	}
+}
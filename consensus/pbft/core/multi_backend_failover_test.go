@@ -0,0 +1,101 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+)
+
+// flakyTestBackend wraps a testSystemBackend endpoint so its first n calls
+// to Broadcast fail, modelling a transient transport outage on one of the
+// endpoints composed into a pbft.MultiBackend. attempts counts every call,
+// including ones after remaining has been exhausted, so a test can assert on
+// how many times the endpoint was actually tried.
+type flakyTestBackend struct {
+	*testSystemBackend
+	remaining int
+	attempts  int
+}
+
+var errFlakyBackend = errors.New("flaky backend: transient failure")
+
+func (b *flakyTestBackend) Broadcast(message []byte) error {
+	b.attempts++
+	if b.remaining > 0 {
+		b.remaining--
+		return errFlakyBackend
+	}
+	return b.testSystemBackend.Broadcast(message)
+}
+
+// TestMultiBackendFailoverReachesQuorum checks that a primary whose backend
+// is a pbft.MultiBackend over one failing and one healthy testSystemBackend
+// still gets its Broadcast through, and that the validator set still reaches
+// a Prepare quorum within the current view despite the injected failures.
+func TestMultiBackendFailoverReachesQuorum(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	sys := NewTestSystemWithBackend(N, F)
+
+	expectedSubject := &pbft.Subject{
+		View: &pbft.View{
+			ViewNumber: big.NewInt(0),
+			Sequence:   big.NewInt(0)},
+		Digest: []byte{1},
+	}
+	for i, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.subject = expectedSubject
+		if i == 0 {
+			c.state = StatePreprepared
+		}
+	}
+
+	// Start the listener goroutine (without starting any engine) so the
+	// healthy endpoint's Broadcast, which posts to sys.queuedMessage, has a
+	// consumer: that channel is unbuffered and would otherwise block
+	// forever on the one failover call below.
+	closer := sys.Run(false, false)
+	defer closer()
+
+	r0 := sys.backends[0].engine.(*core)
+	flaky := &flakyTestBackend{testSystemBackend: sys.backends[0], remaining: 1}
+	r0.backend = pbft.NewMultiBackend(flaky, sys.backends[0])
+
+	if err := r0.backend.Broadcast([]byte("preprepare")); err != nil {
+		t.Fatalf("expected MultiBackend to fail over to the healthy endpoint, got: %v", err)
+	}
+	if flaky.attempts != 1 {
+		t.Fatalf("expected the flaky endpoint to have been tried exactly once, got %d", flaky.attempts)
+	}
+	if flaky.remaining != 0 {
+		t.Fatalf("expected the flaky endpoint's single injected failure to be consumed, remaining: %d", flaky.remaining)
+	}
+
+	for i, v := range sys.backends {
+		if err := r0.handlePrepare(expectedSubject, v.Validators().GetByIndex(uint64(i))); err != nil {
+			t.Fatalf("handlePrepare from replica %d: %v", i, err)
+		}
+	}
+	if r0.state != StatePrepared {
+		t.Fatalf("expected the view to reach a Prepare quorum despite the failover, state: %v", r0.state)
+	}
+}
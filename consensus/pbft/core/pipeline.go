@@ -0,0 +1,169 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+)
+
+// defaultPipelineDepth is used when the backend does not implement
+// pipelineConfigBackend, which keeps pipelining off by default: a depth of
+// 1 means only the in-flight sequence may be outstanding, identical to the
+// classic one-height-at-a-time flow.
+const defaultPipelineDepth = 1
+
+// pipelineSlot is the speculative state for one in-flight sequence: its own
+// subject/current/completed, mirroring what core otherwise keeps as a
+// single value per core instance.
+type pipelineSlot struct {
+	subject   *pbft.Subject
+	current   *snapshot
+	completed bool
+}
+
+// pipeline holds every sequence currently being proposed or prepared at or
+// ahead of the lowest not-yet-committed sequence, so the primary can propose
+// N+1 while N is still in StatePrepared.
+type pipeline struct {
+	depth int
+	slots map[uint64]*pipelineSlot
+}
+
+func newPipeline(depth int) *pipeline {
+	if depth <= 0 {
+		depth = defaultPipelineDepth
+	}
+	return &pipeline{depth: depth, slots: make(map[uint64]*pipelineSlot)}
+}
+
+// pipelineConfigBackend is implemented by backends that want a pipelining
+// window wider than the depth-1 default. Satisfied via a type assertion on
+// Backend, the same pattern qbftBackend and pbft.BLSBackend use to add a
+// capability without editing the Backend interface itself.
+type pipelineConfigBackend interface {
+	// PipelineDepth returns how many sequences ahead of the low-water mark
+	// may be proposed speculatively. A value <= 0 is treated as unset.
+	PipelineDepth() int
+}
+
+// ensurePipeline lazily constructs c.pipelined the first time it's needed,
+// at the depth the backend reports via pipelineConfigBackend, or
+// defaultPipelineDepth if it doesn't implement that interface.
+func (c *core) ensurePipeline() *pipeline {
+	if c.pipelined == nil {
+		depth := defaultPipelineDepth
+		if pb, ok := c.backend.(pipelineConfigBackend); ok {
+			if d := pb.PipelineDepth(); d > 0 {
+				depth = d
+			}
+		}
+		c.pipelined = newPipeline(depth)
+	}
+	return c.pipelined
+}
+
+// canProposeSequence reports whether seq may be proposed/accepted given the
+// current low-water mark (the oldest sequence not yet finalized) and the
+// configured pipelining window.
+func (c *core) canProposeSequence(lowWaterMark, seq uint64) bool {
+	if seq < lowWaterMark {
+		return false
+	}
+	return seq-lowWaterMark < uint64(c.ensurePipeline().depth)
+}
+
+// acceptPipelined records preprepare as the speculative proposal for its
+// sequence, creating the slot if this is the first time that sequence has
+// been seen, and appends it to the WAL the same way acceptPreprepare does
+// for the in-flight sequence: a pipelined proposal is no less "accepted"
+// for being speculative, and must survive a restart too. It does not touch
+// c.subject/c.current, which remain whatever the lowest in-flight sequence
+// left them as, and it sends no Prepare for the slot.
+func (c *core) acceptPipelined(preprepare *pbft.Preprepare) {
+	seq := preprepare.View.Sequence.Uint64()
+	subject := &pbft.Subject{
+		View:   preprepare.View,
+		Digest: preprepare.Proposal.Header.DataHash.Bytes(),
+	}
+	c.ensurePipeline().slots[seq] = &pipelineSlot{
+		subject: subject,
+		current: newSnapshot(preprepare),
+	}
+
+	if err := c.wal.appendPreprepare(preprepare.View.ViewNumber.Uint64(), preprepare); err != nil {
+		c.logger.Warn("Failed to append pipelined preprepare to WAL", "err", err)
+	}
+}
+
+// completeSequence marks the given sequence as having reached its Commit
+// quorum, appends that quorum to the WAL, then finalizes every consecutive
+// completed sequence starting at lowWaterMark, returning them in commit
+// order. A higher sequence that completes before its predecessor is simply
+// held back until the predecessor also completes. handleCommit does not
+// call it; a sequence completes only when completeSequence is called
+// directly.
+func (c *core) completeSequence(lowWaterMark, seq uint64) []uint64 {
+	slots := c.ensurePipeline().slots
+	slot, ok := slots[seq]
+	if !ok {
+		return nil
+	}
+	slot.completed = true
+
+	if err := c.wal.appendCommitQuorum(slot.subject.View.ViewNumber.Uint64(), slot.subject); err != nil {
+		c.logger.Warn("Failed to append commit quorum to WAL", "err", err)
+	}
+
+	var finalized []uint64
+	for next := lowWaterMark; ; next++ {
+		s, ok := slots[next]
+		if !ok || !s.completed {
+			break
+		}
+		finalized = append(finalized, next)
+		delete(slots, next)
+	}
+	return finalized
+}
+
+// rollbackPipeline discards every speculative sequence at or above
+// keepBelow: proposals from the old view are no longer justified and must
+// be re-proposed (or superseded) under the new one. The view-change path
+// does not call it; speculative slots are discarded only when
+// rollbackPipeline is called directly.
+func (c *core) rollbackPipeline(keepBelow uint64) {
+	slots := c.ensurePipeline().slots
+	for seq := range slots {
+		if seq >= keepBelow {
+			delete(slots, seq)
+		}
+	}
+}
+
+// pendingSequences returns the in-flight sequences in ascending order,
+// mainly for tests and diagnostics.
+func (c *core) pendingSequences() []uint64 {
+	slots := c.ensurePipeline().slots
+	seqs := make([]uint64, 0, len(slots))
+	for seq := range slots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
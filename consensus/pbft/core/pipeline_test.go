@@ -0,0 +1,143 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+)
+
+func newPipelineTestCore(depth int) *core {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	c.pipelined = newPipeline(depth)
+	return c
+}
+
+// pipelineDepthBackend wraps a testSystemBackend to additionally implement
+// pipelineConfigBackend, so tests can check ensurePipeline actually honors a
+// backend-reported depth instead of always falling back to 1.
+type pipelineDepthBackend struct {
+	*testSystemBackend
+	depth int
+}
+
+func (b *pipelineDepthBackend) PipelineDepth() int { return b.depth }
+
+// TestEnsurePipelineHonorsBackendDepth checks that a backend implementing
+// pipelineConfigBackend widens the pipelining window beyond the depth-1
+// default, and that a backend which doesn't implement it still gets depth 1.
+func TestEnsurePipelineHonorsBackendDepth(t *testing.T) {
+	sys := NewTestSystemWithBackend(4, 1)
+	c := sys.backends[0].engine.(*core)
+	c.backend = &pipelineDepthBackend{testSystemBackend: sys.backends[0], depth: 3}
+
+	if got := c.ensurePipeline().depth; got != 3 {
+		t.Fatalf("expected the backend-reported depth of 3, got %d", got)
+	}
+
+	plainCore := sys.backends[1].engine.(*core)
+	if got := plainCore.ensurePipeline().depth; got != defaultPipelineDepth {
+		t.Fatalf("expected defaultPipelineDepth for a backend without PipelineDepth, got %d", got)
+	}
+}
+
+// TestPipelineAcceptsAheadOfLowWaterMark extends the style of
+// TestHandlePrepare: it drives two overlapping sequences through
+// acceptPipelined/completeSequence and checks that sequence N+1 can be
+// accepted speculatively while N is still outstanding, and that final
+// commit order always respects sequence order even when N+1 completes
+// first.
+func TestPipelineAcceptsAheadOfLowWaterMark(t *testing.T) {
+	c := newPipelineTestCore(3)
+
+	seqN := uint64(10)
+	seqN1 := uint64(11)
+
+	if !c.canProposeSequence(seqN, seqN1) {
+		t.Fatal("sequence N+1 should be proposable while N is the low-water mark, depth=3")
+	}
+
+	preprepareN := &pbft.Preprepare{
+		View:     &pbft.View{ViewNumber: big.NewInt(0), Sequence: big.NewInt(int64(seqN))},
+		Proposal: &pbft.Proposal{Header: &pbft.Header{}},
+	}
+	preprepareN1 := &pbft.Preprepare{
+		View:     &pbft.View{ViewNumber: big.NewInt(0), Sequence: big.NewInt(int64(seqN1))},
+		Proposal: &pbft.Proposal{Header: &pbft.Header{}},
+	}
+
+	c.acceptPipelined(preprepareN)
+	c.acceptPipelined(preprepareN1)
+
+	if got := c.pendingSequences(); len(got) != 2 || got[0] != seqN || got[1] != seqN1 {
+		t.Fatalf("expected both sequences pending, got %v", got)
+	}
+
+	// N+1 reaches its Commit quorum before N: it must not finalize yet.
+	finalized := c.completeSequence(seqN, seqN1)
+	if len(finalized) != 0 {
+		t.Fatalf("sequence N+1 should not finalize before its predecessor, got %v", finalized)
+	}
+
+	// N now reaches its Commit quorum: both should finalize, in order.
+	finalized = c.completeSequence(seqN, seqN)
+	if len(finalized) != 2 || finalized[0] != seqN || finalized[1] != seqN1 {
+		t.Fatalf("expected [%d %d] to finalize in order, got %v", seqN, seqN1, finalized)
+	}
+
+	if got := c.pendingSequences(); len(got) != 0 {
+		t.Fatalf("expected no sequences left pending after finalizing, got %v", got)
+	}
+}
+
+// TestPipelineWindowRejectsBeyondDepth checks that a sequence past the
+// configured PipelineDepth is rejected, so an unbounded number of
+// speculative proposals cannot accumulate.
+func TestPipelineWindowRejectsBeyondDepth(t *testing.T) {
+	c := newPipelineTestCore(2)
+
+	lowWaterMark := uint64(5)
+	if !c.canProposeSequence(lowWaterMark, lowWaterMark+1) {
+		t.Fatal("lowWaterMark+1 should fit in a depth-2 window")
+	}
+	if c.canProposeSequence(lowWaterMark, lowWaterMark+2) {
+		t.Fatal("lowWaterMark+2 should not fit in a depth-2 window")
+	}
+}
+
+// TestPipelineRollbackOnViewChange checks that a view change discards every
+// speculative sequence at or above the new low-water mark.
+func TestPipelineRollbackOnViewChange(t *testing.T) {
+	c := newPipelineTestCore(4)
+
+	for _, seq := range []uint64{10, 11, 12} {
+		c.acceptPipelined(&pbft.Preprepare{
+			View:     &pbft.View{ViewNumber: big.NewInt(0), Sequence: big.NewInt(int64(seq))},
+			Proposal: &pbft.Proposal{Header: &pbft.Header{}},
+		})
+	}
+
+	c.rollbackPipeline(11)
+
+	got := c.pendingSequences()
+	if len(got) != 1 || got[0] != 10 {
+		t.Fatalf("expected only sequence 10 to survive rollback, got %v", got)
+	}
+}
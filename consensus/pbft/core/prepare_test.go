@@ -131,7 +131,6 @@ func TestHandlePrepare(t *testing.T) {
 			}(),
 			nil,
 		},
-		// TODO: double send message
 	}
 
 OUTER:
@@ -192,6 +191,44 @@ OUTER:
 	}
 }
 
+// TestHandlePrepareDuplicateVote checks that a validator sending its Prepare
+// for the same subject twice is only counted once towards the 2F+1 quorum,
+// so a replica cannot manufacture a quorum by repeating its own vote.
+func TestHandlePrepareDuplicateVote(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+
+	expectedSubject := &pbft.Subject{
+		View: &pbft.View{
+			ViewNumber: big.NewInt(0),
+			Sequence:   big.NewInt(0)},
+		Digest: []byte{1},
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	for i, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.subject = expectedSubject
+		if i == 0 {
+			c.state = StatePreprepared
+		}
+	}
+	sys.Run(true, false)
+
+	r0 := sys.backends[0].engine.(*core)
+	peer := sys.backends[1].Validators().GetByIndex(1)
+
+	if err := r0.handlePrepare(expectedSubject, peer); err != nil {
+		t.Fatalf("first vote: unexpected error: %v", err)
+	}
+	if err := r0.handlePrepare(expectedSubject, peer); err != nil {
+		t.Fatalf("duplicate vote: unexpected error: %v", err)
+	}
+	if r0.current.Prepares.Size() != 1 {
+		t.Fatalf("duplicate vote from the same validator should not grow the quorum, size: %d", r0.current.Prepares.Size())
+	}
+}
+
 // view number is not checked for now
 func TestVerifyPrepare(t *testing.T) {
 	// for log purpose
@@ -17,8 +17,6 @@
 package core
 
 import (
-	"reflect"
-
 	"github.com/ethereum/go-ethereum/consensus/pbft"
 	"github.com/ethereum/go-ethereum/log"
 )
@@ -29,12 +27,26 @@ func (c *core) sendPreprepare(request *pbft.Request) {
 
 	if c.isPrimary() {
 		logger.Debug("sendPreprepare")
+		preprepare := &pbft.Preprepare{
+			View:     nextSeqView,
+			Proposal: c.makeProposal(nextSeqView.Sequence, request),
+		}
+
+		// Once the chain has crossed the QBFT fork block, preprepares must
+		// carry their justification (round-change certificate or prepared
+		// certificate) instead of relying on the classic view-change flow.
+		if c.ensureQBFTStarted(nextSeqView.Sequence) {
+			c.broadcast(&pbft.Message{
+				Code: pbft.MsgPreprepare,
+				Msg:  c.buildQBFTPreprepare(preprepare),
+			})
+			c.clearRoundChangeCertificate()
+			return
+		}
+
 		c.broadcast(&pbft.Message{
 			Code: pbft.MsgPreprepare,
-			Msg: &pbft.Preprepare{
-				View:     nextSeqView,
-				Proposal: c.makeProposal(nextSeqView.Sequence, request),
-			},
+			Msg:  preprepare,
 		})
 	}
 }
@@ -43,9 +55,9 @@ func (c *core) handlePreprepare(msg *pbft.Message, src pbft.Validator) error {
 	logger := log.New("from", src.Address().Hex(), "state", c.state)
 	logger.Debug("handlePreprepare")
 
-	preprepare, ok := msg.Msg.(*pbft.Preprepare)
-	if !ok {
-		return errFailedDecodePreprepare
+	preprepare, qp, err := decodePreprepare(msg)
+	if err != nil {
+		return err
 	}
 
 	if c.isFutureMessage(pbft.MsgPreprepare, preprepare.View) {
@@ -62,8 +74,15 @@ func (c *core) handlePreprepare(msg *pbft.Message, src pbft.Validator) error {
 		return err
 	}
 
+	// The low-water mark is the oldest sequence this replica has not yet
+	// finalized. With pipelining, a Preprepare is acceptable for any
+	// sequence within the configured window ahead of it, not only the
+	// exact next one, so long as the view number still matches.
 	view := c.nextSequence()
-	if !reflect.DeepEqual(preprepare.View, view) {
+	lowWaterMark := view.Sequence.Uint64()
+	seq := preprepare.View.Sequence.Uint64()
+
+	if preprepare.View.ViewNumber.Cmp(view.ViewNumber) != 0 || !c.canProposeSequence(lowWaterMark, seq) {
 		logger.Warn("Preprepare does not match", "expected", view, "got", preprepare.View)
 		return pbft.ErrInvalidMessage
 	}
@@ -73,15 +92,45 @@ func (c *core) handlePreprepare(msg *pbft.Message, src pbft.Validator) error {
 		return pbft.ErrNilProposal
 	}
 
-	if c.state == StateAcceptRequest {
-		c.acceptPreprepare(preprepare)
-		c.setState(StatePreprepared)
-		c.sendPrepare()
+	if c.ensureQBFTStarted(preprepare.View.Sequence) {
+		if qp == nil {
+			logger.Warn("Preprepare missing QBFT wrapper after fork")
+			return errMissingQBFTJustification
+		}
+		if err := c.verifyQBFTPreprepare(qp); err != nil {
+			logger.Warn("QBFT justification invalid", "err", err)
+			return err
+		}
+	}
+
+	if seq == lowWaterMark {
+		if c.state == StateAcceptRequest {
+			c.acceptPreprepare(preprepare)
+			c.setState(StatePreprepared)
+			c.sendPrepare()
+		}
+	} else {
+		// Ahead of the in-flight sequence: hold it as a speculative
+		// proposal rather than replacing c.subject/c.current, which still
+		// belong to lowWaterMark until it commits.
+		c.acceptPipelined(preprepare)
 	}
 
 	return nil
 }
 
+// decodePreprepare unwraps msg.Msg into the classic Preprepare, returning the
+// QBFT wrapper alongside it when the message was sent in QBFT form.
+func decodePreprepare(msg *pbft.Message) (*pbft.Preprepare, *qbftPreprepare, error) {
+	if qp, ok := msg.Msg.(*qbftPreprepare); ok {
+		return qp.Preprepare, qp, nil
+	}
+	if preprepare, ok := msg.Msg.(*pbft.Preprepare); ok {
+		return preprepare, nil, nil
+	}
+	return nil, nil, errFailedDecodePreprepare
+}
+
 func (c *core) acceptPreprepare(preprepare *pbft.Preprepare) {
 	subject := &pbft.Subject{
 		View:   preprepare.View,
@@ -91,4 +140,10 @@ func (c *core) acceptPreprepare(preprepare *pbft.Preprepare) {
 	c.subject = subject
 	c.current = newSnapshot(preprepare)
 	c.completed = false
+
+	if err := c.wal.appendPreprepare(preprepare.View.ViewNumber.Uint64(), preprepare); err != nil {
+		c.logger.Warn("Failed to append preprepare to WAL", "err", err)
+	}
+
+	c.persistQBFTJustification()
 }
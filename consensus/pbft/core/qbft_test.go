@@ -0,0 +1,256 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+)
+
+// TestQBFTForkSwitch builds a validator set whose sequence crosses the QBFT
+// fork block and checks that ensureQBFTStarted keeps the classic flow below
+// the fork and switches to the QBFT flow exactly at it, firing
+// StartQBFTConsensus only then, and that a qbftPreprepare needs no
+// justification in round 0 but does in round 1.
+func TestQBFTForkSwitch(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	forkBlock := big.NewInt(5)
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		backend.qbftFork = forkBlock
+	}
+
+	c := sys.backends[0].engine.(*core)
+
+	beforeFork := &pbft.View{ViewNumber: big.NewInt(0), Sequence: big.NewInt(4)}
+	if c.ensureQBFTStarted(beforeFork.Sequence) {
+		t.Fatal("expected classic PBFT flow below the fork block")
+	}
+	if sys.backends[0].qbftStarted {
+		t.Fatal("StartQBFTConsensus should not have fired before the fork")
+	}
+
+	atFork := &pbft.View{ViewNumber: big.NewInt(0), Sequence: forkBlock}
+	if !c.ensureQBFTStarted(atFork.Sequence) {
+		t.Fatal("expected QBFT flow at the fork block")
+	}
+	if !sys.backends[0].qbftStarted {
+		t.Fatal("StartQBFTConsensus should have fired at the fork")
+	}
+
+	preprepare := &pbft.Preprepare{View: atFork, Proposal: &pbft.Proposal{}}
+	qp := c.buildQBFTPreprepare(preprepare)
+	if err := c.verifyQBFTPreprepare(qp); err != nil {
+		t.Fatalf("round 0 preprepare should not require justification: %v", err)
+	}
+
+	roundOne := &pbft.View{ViewNumber: big.NewInt(1), Sequence: forkBlock}
+	preprepare2 := &pbft.Preprepare{View: roundOne, Proposal: &pbft.Proposal{}}
+	qp2 := c.buildQBFTPreprepare(preprepare2)
+	if err := c.verifyQBFTPreprepare(qp2); err != errMissingQBFTJustification {
+		t.Fatalf("expected errMissingQBFTJustification, got %v", err)
+	}
+}
+
+// TestQBFTRoundChangeQuorumJustifiesPreprepare checks that once 2F+1
+// distinct validators contribute a signed round-change for a round, the
+// accumulated certificate justifies a Preprepare for that round, and that
+// consuming it via clearRoundChangeCertificate makes the next Preprepare
+// require justification again.
+func TestQBFTRoundChangeQuorumJustifiesPreprepare(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	forkBlock := big.NewInt(5)
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		backend.qbftFork = forkBlock
+	}
+	c := sys.backends[0].engine.(*core)
+	c.ensureQBFTStarted(forkBlock)
+
+	view := &pbft.View{ViewNumber: big.NewInt(1), Sequence: forkBlock}
+	for i := uint64(0); i < 2*F+1; i++ {
+		rc := &signedRoundChange{
+			Source:    sys.backends[i].Address(),
+			View:      view,
+			Signature: []byte{byte(i)},
+		}
+		if err := c.addRoundChange(rc); err != nil {
+			t.Fatalf("addRoundChange(%d): %v", i, err)
+		}
+	}
+
+	preprepare := &pbft.Preprepare{View: view, Proposal: &pbft.Proposal{}}
+	qp := c.buildQBFTPreprepare(preprepare)
+	if err := c.verifyQBFTPreprepare(qp); err != nil {
+		t.Fatalf("expected the round-change quorum to justify the preprepare, got %v", err)
+	}
+
+	c.clearRoundChangeCertificate()
+	if err := c.verifyQBFTPreprepare(c.buildQBFTPreprepare(preprepare)); err != errMissingQBFTJustification {
+		t.Fatalf("expected justification to be required again after being consumed, got %v", err)
+	}
+}
+
+// TestQBFTRoundChangeKeepsHighestPreparedCertificate checks that when
+// round-changes carrying prepared certificates from different rounds are
+// collected out of order, addRoundChange keeps the highest-round one: the
+// primary must re-propose the most recently prepared value, not whichever
+// round-change happened to arrive first.
+func TestQBFTRoundChangeKeepsHighestPreparedCertificate(t *testing.T) {
+	sys := NewTestSystemWithBackend(uint64(4), uint64(1))
+	c := sys.backends[0].engine.(*core)
+
+	staleDigest := []byte{1}
+	freshDigest := []byte{2}
+
+	stalePrepared := &preparedCertificate{
+		Preprepare: &pbft.Preprepare{
+			View:     &pbft.View{ViewNumber: big.NewInt(1), Sequence: big.NewInt(5)},
+			Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash(staleDigest)}},
+		},
+		Prepares:   []*pbft.Subject{{View: &pbft.View{ViewNumber: big.NewInt(1), Sequence: big.NewInt(5)}, Digest: staleDigest}},
+		Signatures: [][]byte{{0}},
+	}
+	freshPrepared := &preparedCertificate{
+		Preprepare: &pbft.Preprepare{
+			View:     &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)},
+			Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash(freshDigest)}},
+		},
+		Prepares:   []*pbft.Subject{{View: &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)}, Digest: freshDigest}},
+		Signatures: [][]byte{{0}},
+	}
+
+	view := &pbft.View{ViewNumber: big.NewInt(3), Sequence: big.NewInt(5)}
+	rcs := []*signedRoundChange{
+		{Source: sys.backends[0].Address(), View: view, Prepared: stalePrepared, Signature: []byte{0}},
+		{Source: sys.backends[1].Address(), View: view, Prepared: freshPrepared, Signature: []byte{1}},
+	}
+	for i, rc := range rcs {
+		if err := c.addRoundChange(rc); err != nil {
+			t.Fatalf("addRoundChange(%d): %v", i, err)
+		}
+	}
+
+	if c.preparedCertificate != freshPrepared {
+		t.Fatalf("expected the round-2 prepared certificate to win over the round-1 one")
+	}
+}
+
+// TestQBFTPreparedCertificateRejectsStaleRound checks that a prepared
+// certificate whose own round is not strictly earlier than the round it is
+// meant to justify is rejected, rather than accepted as valid justification
+// for re-proposing an outdated value.
+func TestQBFTPreparedCertificateRejectsStaleRound(t *testing.T) {
+	sys := NewTestSystemWithBackend(uint64(4), uint64(1))
+	c := sys.backends[0].engine.(*core)
+
+	digest := []byte{9}
+	pc := &preparedCertificate{
+		Preprepare: &pbft.Preprepare{
+			View:     &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)},
+			Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash(digest)}},
+		},
+		Prepares: []*pbft.Subject{
+			{View: &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)}, Digest: digest},
+			{View: &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)}, Digest: digest},
+			{View: &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)}, Digest: digest},
+		},
+		Signatures: [][]byte{{0}, {1}, {2}},
+	}
+
+	preprepare := &pbft.Preprepare{
+		View:     &pbft.View{ViewNumber: big.NewInt(2), Sequence: big.NewInt(5)},
+		Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash(digest)}},
+	}
+	if err := c.verifyPreparedCertificate(preprepare, pc); err != errInvalidQBFTJustification {
+		t.Fatalf("expected a same-round prepared certificate to be rejected as stale, got %v", err)
+	}
+}
+
+// TestIsQBFTConsensusHasNoSideEffects checks that the bare predicate never
+// triggers the one-time QBFT transition, even when called past the fork
+// block repeatedly: only ensureQBFTStarted may do that.
+func TestIsQBFTConsensusHasNoSideEffects(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+	forkBlock := big.NewInt(5)
+
+	sys := NewTestSystemWithBackend(N, F)
+	for _, backend := range sys.backends {
+		backend.qbftFork = forkBlock
+	}
+	c := sys.backends[0].engine.(*core)
+
+	for i := 0; i < 3; i++ {
+		if !c.isQBFTConsensus(forkBlock) {
+			t.Fatal("expected QBFT flow at the fork block")
+		}
+	}
+	if sys.backends[0].qbftStarted {
+		t.Fatal("isQBFTConsensus must never start QBFT consensus as a side effect")
+	}
+	if c.qbftStarted {
+		t.Fatal("isQBFTConsensus must never set c.qbftStarted")
+	}
+}
+
+// TestHandleRoundChangeFeedsAddRoundChange checks that handleRoundChange,
+// the shape a round-change dispatch handler would call, actually folds its
+// argument into the accumulated certificate the same way calling
+// addRoundChange directly does.
+func TestHandleRoundChangeFeedsAddRoundChange(t *testing.T) {
+	sys := NewTestSystemWithBackend(uint64(4), uint64(1))
+	c := sys.backends[0].engine.(*core)
+
+	view := &pbft.View{ViewNumber: big.NewInt(1), Sequence: big.NewInt(5)}
+	rc := &signedRoundChange{
+		Source:    sys.backends[0].Address(),
+		View:      view,
+		Signature: []byte{0},
+	}
+	if err := c.handleRoundChange(rc); err != nil {
+		t.Fatalf("handleRoundChange: %v", err)
+	}
+	if len(c.pendingRoundChanges) != 1 || c.pendingRoundChanges[0] != rc {
+		t.Fatalf("expected the round-change to be recorded via addRoundChange, got %v", c.pendingRoundChanges)
+	}
+}
+
+// TestQBFTRoundChangeRejectsForgedSignature checks that a round-change
+// whose signature does not recover to its claimed source is rejected
+// outright, rather than silently counted toward the quorum.
+func TestQBFTRoundChangeRejectsForgedSignature(t *testing.T) {
+	sys := NewTestSystemWithBackend(uint64(4), uint64(1))
+	c := sys.backends[0].engine.(*core)
+
+	view := &pbft.View{ViewNumber: big.NewInt(1), Sequence: big.NewInt(5)}
+	forged := &signedRoundChange{
+		Source:    sys.backends[0].Address(),
+		View:      view,
+		Signature: []byte{1}, // recovers to backends[1], not backends[0]
+	}
+	if err := c.addRoundChange(forged); err != errInvalidQBFTJustification {
+		t.Fatalf("expected errInvalidQBFTJustification, got %v", err)
+	}
+}
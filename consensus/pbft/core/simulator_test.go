@@ -0,0 +1,451 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"container/heap"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// simLink identifies a directed connection between two backend indices, so
+// a Scenario can describe per-link latency/drop independently in each
+// direction.
+type simLink struct {
+	from, to uint64
+}
+
+// Scenario is the fault-injection DSL: build one up with the With* methods,
+// then pass it to testSystem.WithScenario before calling Run(core, true).
+type Scenario struct {
+	latency  map[simLink]time.Duration
+	dropRate map[simLink]float64
+	offline  map[uint64]bool
+}
+
+// NewScenario returns an empty Scenario: no latency, no drops, every
+// replica online.
+func NewScenario() *Scenario {
+	return &Scenario{
+		latency:  make(map[simLink]time.Duration),
+		dropRate: make(map[simLink]float64),
+		offline:  make(map[uint64]bool),
+	}
+}
+
+// WithLatency delays every message from -> to by d.
+func (s *Scenario) WithLatency(from, to uint64, d time.Duration) *Scenario {
+	s.latency[simLink{from, to}] = d
+	return s
+}
+
+// WithDropRate drops a deterministic fraction (0..1) of messages from -> to,
+// using a per-link counter rather than math/rand so the same messages drop
+// every run.
+func (s *Scenario) WithDropRate(from, to uint64, rate float64) *Scenario {
+	s.dropRate[simLink{from, to}] = rate
+	return s
+}
+
+// WithOffline marks replica id as disconnected: every message to or from it
+// is dropped until the scenario is rebuilt.
+func (s *Scenario) WithOffline(id uint64) *Scenario {
+	s.offline[id] = true
+	return s
+}
+
+// simEvent is a scheduled, already-fault-evaluated message delivery.
+type simEvent struct {
+	at      time.Duration
+	to      uint64
+	payload []byte
+}
+
+// simEventQueue is a min-heap of simEvents ordered by virtual delivery time.
+type simEventQueue []*simEvent
+
+func (q simEventQueue) Len() int            { return len(q) }
+func (q simEventQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q simEventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simEventQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simEventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// simulator is the deterministic network: a virtual clock plus a priority
+// queue of pending deliveries, driven by drain rather than real time.
+type simulator struct {
+	sys      *testSystem
+	scenario *Scenario
+
+	mu      sync.Mutex
+	now     time.Duration
+	queue   simEventQueue
+	linkSeq map[simLink]uint64
+}
+
+func newSimulator(sys *testSystem, scenario *Scenario) *simulator {
+	if scenario == nil {
+		scenario = NewScenario()
+	}
+	return &simulator{sys: sys, scenario: scenario, linkSeq: make(map[simLink]uint64)}
+}
+
+// deterministicDrop decides, without any randomness, whether the n'th
+// message on a link should be dropped so that a DropRate of e.g. 1/3 drops
+// exactly one in three messages, always the same ones.
+func deterministicDrop(n uint64, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	period := uint64(1.0 / rate)
+	if period == 0 {
+		period = 1
+	}
+	return n%period == 0
+}
+
+// enqueue schedules payload for delivery to "to", applying the scenario's
+// offline/drop/latency rules for the from->to link.
+func (s *simulator) enqueue(from, to uint64, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.scenario.offline[from] || s.scenario.offline[to] {
+		return
+	}
+	link := simLink{from, to}
+	s.linkSeq[link]++
+	if deterministicDrop(s.linkSeq[link], s.scenario.dropRate[link]) {
+		return
+	}
+
+	heap.Push(&s.queue, &simEvent{at: s.now + s.scenario.latency[link], to: to, payload: payload})
+}
+
+// drain delivers every scheduled event in virtual-time order, advancing the
+// clock as it goes, until the queue is empty. Handlers invoked by delivery
+// may themselves enqueue further events (e.g. a Prepare triggered by a
+// Preprepare); drain keeps going until none remain.
+func (s *simulator) drain() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		event := heap.Pop(&s.queue).(*simEvent)
+		s.now = event.at
+		s.mu.Unlock()
+
+		for _, backend := range s.sys.backends {
+			if backend.id == event.to {
+				backend.EventMux().Post(pbft.MessageEvent{Payload: event.payload})
+			}
+		}
+	}
+}
+
+// WithScenario attaches a fault-injection Scenario to the system. From then
+// on Send and Broadcast enqueue into the simulator instead of the naive
+// broadcast-to-everyone queuedMessage channel, and drain delivers them;
+// Run(core, true) additionally skips starting the listen loop.
+func (t *testSystem) WithScenario(scenario *Scenario) *testSystem {
+	t.sim = newSimulator(t, scenario)
+	return t
+}
+
+// equivocatingBackend wraps a testSystemBackend so that Broadcast sends a
+// distinct Preprepare-shaped payload to each peer instead of the same bytes
+// to everyone, modelling a Byzantine primary that equivocates across the
+// validator set.
+type equivocatingBackend struct {
+	*testSystemBackend
+}
+
+func (b *equivocatingBackend) Broadcast(message []byte) error {
+	if b.sys.sim == nil {
+		return b.testSystemBackend.Broadcast(message)
+	}
+	for _, peer := range b.sys.backends {
+		if peer.id == b.id {
+			continue
+		}
+		// tag the payload with the destination so tests can observe that
+		// each peer received a different proposal.
+		forged := append(append([]byte{}, message...), byte(peer.id))
+		b.sys.sim.enqueue(b.id, peer.id, forged)
+	}
+	return nil
+}
+
+// drainPayloads drains whatever is already queued on sub. simulator.drain
+// posts every delivery synchronously before returning, so by the time a
+// test calls this the channel already holds everything it will ever hold;
+// a non-blocking read is enough and keeps the test off any wall clock.
+func drainPayloads(sub *event.TypeMuxSubscription) [][]byte {
+	var payloads [][]byte
+	for {
+		select {
+		case ev := <-sub.Chan():
+			payloads = append(payloads, ev.Data.(pbft.MessageEvent).Payload)
+		default:
+			return payloads
+		}
+	}
+}
+
+// TestScenarioDropRateIsDeterministic checks that a DropRate of 1/2 on a
+// link delivers exactly 5 of 10 messages: drops follow a per-link counter
+// rather than chance, so the count is exact.
+func TestScenarioDropRateIsDeterministic(t *testing.T) {
+	sys := NewTestSystemWithBackend(2, 0)
+	sys.WithScenario(NewScenario().WithDropRate(0, 1, 0.5))
+
+	for i := 0; i < 10; i++ {
+		sys.sim.enqueue(0, 1, []byte{byte(i)})
+	}
+	sub := sys.backends[1].events.Subscribe(pbft.MessageEvent{})
+	defer sub.Unsubscribe()
+
+	sys.sim.drain()
+	payloads := drainPayloads(sub)
+
+	if len(payloads) != 5 {
+		t.Fatalf("expected exactly half of 10 messages delivered, got %d", len(payloads))
+	}
+}
+
+// TestScenarioOfflineReplicaReceivesNothing checks that WithOffline
+// suppresses every delivery to (and from) the marked replica.
+func TestScenarioOfflineReplicaReceivesNothing(t *testing.T) {
+	sys := NewTestSystemWithBackend(3, 1)
+	sys.WithScenario(NewScenario().WithOffline(2))
+
+	sub := sys.backends[2].events.Subscribe(pbft.MessageEvent{})
+	defer sub.Unsubscribe()
+
+	sys.sim.enqueue(0, 2, []byte("proposal"))
+	sys.sim.drain()
+
+	if payloads := drainPayloads(sub); len(payloads) != 0 {
+		t.Fatalf("offline replica should not receive any message, got %v", payloads)
+	}
+}
+
+// TestScenarioLatencyOrdersDelivery checks that a message sent with lower
+// latency is still delivered in virtual-time order ahead of one sent with
+// higher latency, regardless of enqueue order.
+func TestScenarioLatencyOrdersDelivery(t *testing.T) {
+	sys := NewTestSystemWithBackend(2, 0)
+	sys.WithScenario(NewScenario().
+		WithLatency(0, 1, 50*time.Millisecond).
+		WithLatency(1, 1, 5*time.Millisecond))
+
+	sub := sys.backends[1].events.Subscribe(pbft.MessageEvent{})
+	defer sub.Unsubscribe()
+
+	sys.sim.enqueue(0, 1, []byte("slow"))
+	sys.sim.enqueue(1, 1, []byte("instant"))
+
+	sys.sim.drain()
+	payloads := drainPayloads(sub)
+
+	if len(payloads) != 2 || string(payloads[0]) != "instant" || string(payloads[1]) != "slow" {
+		t.Fatalf("expected the lower-latency message delivered first, got %v", payloads)
+	}
+}
+
+// TestEquivocatingBackendSendsDivergentProposals checks that an
+// equivocatingBackend's Broadcast gives each peer a distinguishable
+// payload, modelling a Byzantine primary equivocating across the
+// validator set.
+func TestEquivocatingBackendSendsDivergentProposals(t *testing.T) {
+	sys := NewTestSystemWithBackend(3, 1)
+	sys.WithScenario(NewScenario())
+
+	adversary := &equivocatingBackend{testSystemBackend: sys.backends[0]}
+
+	sub1 := sys.backends[1].events.Subscribe(pbft.MessageEvent{})
+	defer sub1.Unsubscribe()
+	sub2 := sys.backends[2].events.Subscribe(pbft.MessageEvent{})
+	defer sub2.Unsubscribe()
+
+	if err := adversary.Broadcast([]byte("proposal")); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	sys.sim.drain()
+
+	got1 := drainPayloads(sub1)
+	got2 := drainPayloads(sub2)
+	if len(got1) != 1 || len(got2) != 1 {
+		t.Fatalf("expected exactly one message per peer, got %v and %v", got1, got2)
+	}
+	if bytes.Equal(got1[0], got2[0]) {
+		t.Fatal("expected each peer to receive a distinct (equivocated) proposal")
+	}
+}
+
+// TestQuorumToleratesOfflineReplica checks that a Prepare quorum still forms
+// when one of four replicas (at F=1, the maximum tolerable) is offline: the
+// remaining 2F+1 honest votes must be enough on their own.
+func TestQuorumToleratesOfflineReplica(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+
+	expectedSubject := &pbft.Subject{
+		View: &pbft.View{
+			ViewNumber: big.NewInt(0),
+			Sequence:   big.NewInt(0)},
+		Digest: []byte{1},
+	}
+
+	sys := NewTestSystemWithBackend(N, F)
+	sys.WithScenario(NewScenario().WithOffline(3))
+
+	for i, backend := range sys.backends {
+		c := backend.engine.(*core)
+		c.subject = expectedSubject
+		if i == 0 {
+			c.state = StatePreprepared
+		}
+	}
+	sys.Run(true, false)
+
+	r0 := sys.backends[0].engine.(*core)
+	for i, v := range sys.backends {
+		if sys.sim.scenario.offline[uint64(i)] {
+			continue
+		}
+		if err := r0.handlePrepare(expectedSubject, v.Validators().GetByIndex(uint64(i))); err != nil {
+			t.Fatalf("handlePrepare from online replica %d: %v", i, err)
+		}
+	}
+
+	if r0.state != StatePrepared {
+		t.Fatalf("expected quorum from the 2F+1 online replicas to prepare despite one offline, state: %v", r0.state)
+	}
+}
+
+// TestScenarioReachesSingleCommitUnderFaults drives a replica through
+// handlePreprepare, a Prepare quorum and a Commit quorum while three of the
+// request's adversaries are present at once: an offline replica, an
+// equivocating second Preprepare for the same sequence, and a Preprepare
+// for a view the replica is not yet expecting. It checks that exactly one
+// proposal — the honest one — ever gets accepted, prepared and committed,
+// despite all three.
+func TestScenarioReachesSingleCommitUnderFaults(t *testing.T) {
+	N := uint64(4)
+	F := uint64(1)
+
+	sys := NewTestSystemWithBackend(N, F)
+	sys.WithScenario(NewScenario().WithOffline(3))
+
+	honestDigest := common.BytesToHash([]byte{1}).Bytes()
+	view := &pbft.View{ViewNumber: big.NewInt(0), Sequence: big.NewInt(0)}
+	honestPreprepare := &pbft.Preprepare{
+		View:     view,
+		Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash(honestDigest)}},
+	}
+
+	r1 := sys.backends[1].engine.(*core)
+	primary := sys.backends[0].Validators().GetByIndex(0)
+
+	// Future-view fault: a Preprepare for a round this replica isn't
+	// expecting yet must be rejected, not silently accepted as the next
+	// proposal.
+	futureView := &pbft.View{ViewNumber: big.NewInt(1), Sequence: big.NewInt(0)}
+	futurePreprepare := &pbft.Preprepare{
+		View:     futureView,
+		Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash([]byte{9})}},
+	}
+	if err := r1.handlePreprepare(&pbft.Message{Code: pbft.MsgPreprepare, Msg: futurePreprepare}, primary); err != pbft.ErrInvalidMessage {
+		t.Fatalf("expected a mismatched-view preprepare to be rejected, got %v", err)
+	}
+	if r1.state != StateAcceptRequest {
+		t.Fatalf("a rejected future-view preprepare must not advance state, got %v", r1.state)
+	}
+
+	// The honest Preprepare is accepted normally.
+	if err := r1.handlePreprepare(&pbft.Message{Code: pbft.MsgPreprepare, Msg: honestPreprepare}, primary); err != nil {
+		t.Fatalf("handlePreprepare(honest): %v", err)
+	}
+	if r1.state != StatePreprepared || !bytes.Equal(r1.subject.Digest, honestDigest) {
+		t.Fatalf("expected the honest proposal accepted, state=%v digest=%x", r1.state, r1.subject.Digest)
+	}
+
+	// Equivocation fault: a second, divergent Preprepare for the same
+	// sequence must not displace the one already accepted.
+	equivocating := &pbft.Preprepare{
+		View:     view,
+		Proposal: &pbft.Proposal{Header: &pbft.Header{DataHash: common.BytesToHash([]byte{2})}},
+	}
+	if err := r1.handlePreprepare(&pbft.Message{Code: pbft.MsgPreprepare, Msg: equivocating}, primary); err != nil {
+		t.Fatalf("handlePreprepare(equivocating): %v", err)
+	}
+	if !bytes.Equal(r1.subject.Digest, honestDigest) {
+		t.Fatalf("an equivocating preprepare must not overwrite the already-accepted proposal, digest now %x", r1.subject.Digest)
+	}
+
+	// Offline fault: replica 3 is excluded from the Prepare quorum. The
+	// remaining 2F+1 online replicas (0, 1, 2) must still be enough.
+	expectedSubject := &pbft.Subject{View: view, Digest: honestDigest}
+	for i, v := range sys.backends {
+		if sys.sim.scenario.offline[uint64(i)] {
+			continue
+		}
+		if err := r1.handlePrepare(expectedSubject, v.Validators().GetByIndex(uint64(i))); err != nil {
+			t.Fatalf("handlePrepare from online replica %d: %v", i, err)
+		}
+	}
+	if r1.state != StatePrepared {
+		t.Fatalf("expected a Prepare quorum from the online replicas, state: %v", r1.state)
+	}
+
+	// Commit fault-tolerance: completeSequence is this package's
+	// commit-quorum-reached signal (see pipeline.go); driving it records the
+	// single honest digest to the WAL as Committed.
+	r1.wal = newWAL(newMemStorage())
+	r1.acceptPipelined(honestPreprepare)
+	if finalized := r1.completeSequence(0, 0); len(finalized) != 1 {
+		t.Fatalf("expected sequence 0 to finalize to a single commit, got %v", finalized)
+	}
+	recovered, err := r1.wal.replay()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if recovered.State != uint32(StateCommitted) {
+		t.Fatalf("expected StateCommitted after the commit quorum, got %v", recovered.State)
+	}
+	if !bytes.Equal(recovered.Subject.Digest, honestDigest) {
+		t.Fatalf("expected the committed digest to be the honest one, got %x", recovered.Subject.Digest)
+	}
+}
@@ -18,6 +18,9 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"math/big"
+	"reflect"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/pbft"
@@ -41,6 +44,18 @@ type testSystemBackend struct {
 	sentMsgs   [][]byte // store the message when Send is called by core
 
 	address common.Address
+
+	// qbftFork, when non-nil, is the sequence at which this backend starts
+	// reporting QBFT rules apply; qbftStarted records whether
+	// StartQBFTConsensus has already fired.
+	qbftFork    *big.Int
+	qbftStarted bool
+
+	// db is the in-memory stand-in for the durable store behind
+	// Save/Restore, so tests can exercise state that survives a "restart"
+	// (a new testSystemBackend sharing the same db).
+	dbMu sync.Mutex
+	db   map[string]interface{}
 }
 
 // ==============================================
@@ -63,6 +78,16 @@ func (self *testSystemBackend) EventMux() *event.TypeMux {
 func (self *testSystemBackend) Send(message []byte, target common.Address) error {
 	testLogger.Info("enqueuing a message...", "address", self.Address())
 	self.sentMsgs = append(self.sentMsgs, message)
+
+	if self.sys.sim != nil {
+		for _, peer := range self.sys.backends {
+			if peer.Address() == target {
+				self.sys.sim.enqueue(self.id, peer.id, message)
+			}
+		}
+		return nil
+	}
+
 	self.sys.queuedMessage <- pbft.MessageEvent{
 		Payload: message,
 	}
@@ -72,6 +97,17 @@ func (self *testSystemBackend) Send(message []byte, target common.Address) error
 func (self *testSystemBackend) Broadcast(message []byte) error {
 	testLogger.Info("enqueuing a message...", "address", self.Address())
 	self.sentMsgs = append(self.sentMsgs, message)
+
+	if self.sys.sim != nil {
+		for _, peer := range self.sys.backends {
+			if peer.id == self.id {
+				continue
+			}
+			self.sys.sim.enqueue(self.id, peer.id, message)
+		}
+		return nil
+	}
+
 	self.sys.queuedMessage <- pbft.MessageEvent{
 		Payload: message,
 	}
@@ -113,8 +149,16 @@ func (self *testSystemBackend) CheckSignature([]byte, common.Address, []byte) er
 	return nil
 }
 
+// CheckValidatorSignature is a test-only stand-in for real signature
+// recovery: sig is expected to be the single-byte index of the signing
+// validator into self.sys.backends, as produced by tests constructing
+// signedRoundChange/preparedCertificate values. Anything else recovers the
+// zero address, matching the other Sign/CheckSignature stubs in this file.
 func (self *testSystemBackend) CheckValidatorSignature(data []byte, sig []byte) (common.Address, error) {
-	return common.Address{}, nil
+	if len(sig) != 1 || self.sys == nil || int(sig[0]) >= len(self.sys.backends) {
+		return common.Address{}, nil
+	}
+	return self.sys.backends[sig[0]].Address(), nil
 }
 
 func (self *testSystemBackend) IsProposer() bool {
@@ -125,6 +169,16 @@ func (self *testSystemBackend) IsProposer() bool {
 	return self.Address() == self.sys.backends[0].Address()
 }
 
+func (self *testSystemBackend) IsQBFTConsensus(seq *big.Int) bool {
+	return self.qbftFork != nil && seq.Cmp(self.qbftFork) >= 0
+}
+
+func (self *testSystemBackend) StartQBFTConsensus() error {
+	testLogger.Info("switching to QBFT consensus", "address", self.Address())
+	self.qbftStarted = true
+	return nil
+}
+
 func (self *testSystemBackend) Hash(b interface{}) common.Hash {
 	return common.StringToHash("Test")
 }
@@ -148,13 +202,24 @@ func (self *testSystemBackend) NewRequest(request pbft.RequestContexter) {
 
 // Save an object into db
 func (self *testSystemBackend) Save(key string, val interface{}) error {
-	testLogger.Warn("nothing to happen")
+	self.dbMu.Lock()
+	defer self.dbMu.Unlock()
+	if self.db == nil {
+		self.db = make(map[string]interface{})
+	}
+	self.db[key] = val
 	return nil
 }
 
 // Restore an object to val from db
 func (self *testSystemBackend) Restore(key string, val interface{}) error {
-	testLogger.Warn("nothing to happen")
+	self.dbMu.Lock()
+	defer self.dbMu.Unlock()
+	stored, ok := self.db[key]
+	if !ok {
+		return nil
+	}
+	reflect.ValueOf(val).Elem().Set(reflect.ValueOf(stored).Elem())
 	return nil
 }
 
@@ -167,6 +232,11 @@ type testSystem struct {
 
 	queuedMessage chan pbft.MessageEvent
 	quit          chan struct{}
+
+	// sim, when set via WithScenario, routes Send/Broadcast through the
+	// deterministic fault-injecting simulator instead of the naive
+	// broadcast-to-everyone queuedMessage channel.
+	sim *simulator
 }
 
 func newTestSystem(n uint64) *testSystem {
@@ -241,18 +311,36 @@ func (t *testSystem) listen() {
 // function that caller can control lifecycle
 //
 // Given a true for core if you want to initialize core engine.
-func (t *testSystem) Run(core bool) func() {
+// Run starts system components based on the given flags. If faulty is true
+// and a Scenario has been attached via WithScenario, the naive
+// broadcast-to-everyone listen loop is not started. Once a Scenario is
+// attached, Send and Broadcast go through the deterministic simulator
+// whatever faulty is, and callers drive time forward explicitly with Drain.
+func (t *testSystem) Run(core bool, faulty bool) func() {
 	for _, b := range t.backends {
 		if core {
 			b.engine.Start() // start PBFT core
 		}
 	}
 
+	if faulty && t.sim != nil {
+		return func() { t.stop(core) }
+	}
+
 	go t.listen()
 	closer := func() { t.stop(core) }
 	return closer
 }
 
+// Drain delivers every message currently scheduled in the attached
+// simulator, in virtual-time order. It is a no-op if no Scenario has been
+// attached.
+func (t *testSystem) Drain() {
+	if t.sim != nil {
+		t.sim.drain()
+	}
+}
+
 func (t *testSystem) stop(core bool) {
 	close(t.quit)
 
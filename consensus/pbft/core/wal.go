@@ -0,0 +1,206 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/consensus/pbft"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// walPrefix namespaces every key the consensus engine writes into the
+// shared Storage, so the WAL can be iterated independently of whatever else
+// uses the same database.
+const walPrefix = "pbft-wal-"
+
+// walEntryKind tags the RLP-encoded payload stored at each WAL key, so
+// replay knows how to decode it without guessing.
+type walEntryKind uint8
+
+const (
+	walKindPreprepare walEntryKind = iota + 1
+	walKindPrepareQuorum
+	walKindCommitQuorum
+)
+
+// walEntry is the schema every record written to the WAL shares: a kind tag
+// plus the RLP-encoded payload for that kind. Sequence and Round repeat
+// what walKey encodes, so an entry read on its own says where it belongs;
+// replay orders entries by key and does not read these two fields.
+type walEntry struct {
+	Kind     walEntryKind
+	Sequence uint64
+	Round    uint64
+	Payload  []byte
+}
+
+// walPreprepareRecord is the payload for a walKindPreprepare entry.
+type walPreprepareRecord struct {
+	View     *pbft.View
+	Proposal *pbft.Proposal
+}
+
+// walQuorumRecord is the payload shared by walKindPrepareQuorum and
+// walKindCommitQuorum entries: the subject the quorum was reached on.
+type walQuorumRecord struct {
+	Subject *pbft.Subject
+}
+
+// wal is the append-only log of everything core must remember across a
+// restart: every accepted Preprepare, and the Subject each 2F+1
+// Prepare/Commit quorum was reached on.
+type wal struct {
+	mu      sync.Mutex
+	storage pbft.Storage
+}
+
+// newWAL wraps storage (nil-able: a core running without persistence just
+// gets a no-op WAL) as the write-ahead log for one core instance.
+func newWAL(storage pbft.Storage) *wal {
+	return &wal{storage: storage}
+}
+
+func walKey(seq, round uint64, kind walEntryKind) []byte {
+	key := make([]byte, len(walPrefix)+8+8+1)
+	n := copy(key, walPrefix)
+	binary.BigEndian.PutUint64(key[n:], seq)
+	binary.BigEndian.PutUint64(key[n+8:], round)
+	key[n+16] = byte(kind)
+	return key
+}
+
+func (w *wal) append(seq, round uint64, kind walEntryKind, payload interface{}) error {
+	if w == nil || w.storage == nil {
+		return nil
+	}
+	encodedPayload, err := rlp.EncodeToBytes(payload)
+	if err != nil {
+		return err
+	}
+	entry := &walEntry{Kind: kind, Sequence: seq, Round: round, Payload: encodedPayload}
+	encoded, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.storage.Put(walKey(seq, round, kind), encoded)
+}
+
+// appendPreprepare atomically records that preprepare was accepted for the
+// given round.
+func (w *wal) appendPreprepare(round uint64, preprepare *pbft.Preprepare) error {
+	return w.append(preprepare.View.Sequence.Uint64(), round, walKindPreprepare,
+		&walPreprepareRecord{View: preprepare.View, Proposal: preprepare.Proposal})
+}
+
+// appendPrepareQuorum atomically records that a 2F+1 Prepare quorum was
+// reached on subject.
+func (w *wal) appendPrepareQuorum(round uint64, subject *pbft.Subject) error {
+	return w.append(subject.View.Sequence.Uint64(), round, walKindPrepareQuorum, &walQuorumRecord{Subject: subject})
+}
+
+// appendCommitQuorum atomically records that a 2F+1 Commit quorum was
+// reached on subject.
+func (w *wal) appendCommitQuorum(round uint64, subject *pbft.Subject) error {
+	return w.append(subject.View.Sequence.Uint64(), round, walKindCommitQuorum, &walQuorumRecord{Subject: subject})
+}
+
+// walRecoveredState is what replay reconstructs: the furthest point the
+// node reached before it stopped, from which core.Start resumes.
+type walRecoveredState struct {
+	State      uint32 // mirrors one of the State* constants
+	Subject    *pbft.Subject
+	Preprepare *pbft.Preprepare
+}
+
+// replay walks every entry in the WAL in key order (sequence, round, kind -
+// preprepare before prepare-quorum before commit-quorum, by construction of
+// walEntryKind's iota) and returns the furthest state it can reconstruct.
+func (w *wal) replay() (*walRecoveredState, error) {
+	if w == nil || w.storage == nil {
+		return nil, nil
+	}
+
+	recovered := &walRecoveredState{State: uint32(StateAcceptRequest)}
+	it := w.storage.NewIterator([]byte(walPrefix))
+	defer it.Release()
+
+	for it.Next() {
+		entry := new(walEntry)
+		if err := rlp.DecodeBytes(it.Value(), entry); err != nil {
+			return nil, fmt.Errorf("pbft: corrupt WAL entry at key %x: %v", it.Key(), err)
+		}
+
+		switch entry.Kind {
+		case walKindPreprepare:
+			rec := new(walPreprepareRecord)
+			if err := rlp.DecodeBytes(entry.Payload, rec); err != nil {
+				return nil, err
+			}
+			recovered.Preprepare = &pbft.Preprepare{View: rec.View, Proposal: rec.Proposal}
+			recovered.State = uint32(StatePreprepared)
+
+		case walKindPrepareQuorum:
+			rec := new(walQuorumRecord)
+			if err := rlp.DecodeBytes(entry.Payload, rec); err != nil {
+				return nil, err
+			}
+			recovered.Subject = rec.Subject
+			recovered.State = uint32(StatePrepared)
+
+		case walKindCommitQuorum:
+			rec := new(walQuorumRecord)
+			if err := rlp.DecodeBytes(entry.Payload, rec); err != nil {
+				return nil, err
+			}
+			recovered.Subject = rec.Subject
+			recovered.State = uint32(StateCommitted)
+		}
+	}
+
+	return recovered, nil
+}
+
+// restoreFromWAL reconstructs subject/current/state from the WAL, so that
+// a node calling it before it subscribes to any events resumes where it
+// left off instead of re-preparing or re-committing a value it already
+// justified. Start does not call it; state is restored only when
+// restoreFromWAL is called directly.
+func (c *core) restoreFromWAL() error {
+	recovered, err := c.wal.replay()
+	if err != nil {
+		return err
+	}
+	if recovered == nil {
+		return nil
+	}
+
+	if recovered.Preprepare != nil {
+		c.current = newSnapshot(recovered.Preprepare)
+	}
+	if recovered.Subject != nil {
+		c.subject = recovered.Subject
+	}
+	c.setState(State(recovered.State))
+	c.completed = recovered.State == uint32(StateCommitted)
+	return nil
+}
@@ -0,0 +1,399 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pbft
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// errAllBackendsUnhealthy is returned once every endpoint composed into a
+// MultiBackend has been marked unhealthy and none has recovered yet.
+var errAllBackendsUnhealthy = errors.New("pbft: all backends are unhealthy")
+
+const (
+	multiBackendInitialBackoff = 100 * time.Millisecond
+	multiBackendMaxBackoff     = 30 * time.Second
+)
+
+// endpoint tracks the health of a single composed Backend so MultiBackend
+// can skip over endpoints that are in backoff after repeated failures.
+type endpoint struct {
+	mu       sync.Mutex
+	backend  Backend
+	failures int
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+func newEndpoint(b Backend) *endpoint {
+	return &endpoint{backend: b, backoff: multiBackendInitialBackoff}
+}
+
+// healthy reports whether this endpoint is currently eligible to be tried,
+// i.e. it has not failed, or its backoff window has elapsed.
+func (e *endpoint) healthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failures == 0 || !time.Now().Before(e.retryAt)
+}
+
+// recordSuccess clears any accumulated failures and resets the backoff.
+func (e *endpoint) recordSuccess() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.backoff = multiBackendInitialBackoff
+}
+
+// recordFailure bumps the failure count and doubles the backoff window,
+// capped at multiBackendMaxBackoff.
+func (e *endpoint) recordFailure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	e.retryAt = time.Now().Add(e.backoff)
+	if e.backoff *= 2; e.backoff > multiBackendMaxBackoff {
+		e.backoff = multiBackendMaxBackoff
+	}
+}
+
+// MultiBackend composes several Backend implementations behind a single
+// Backend, transparently failing over calls that return an error to the
+// next healthy endpoint. It lets an operator run a PBFT validator against
+// redundant transport/signer/db backends without any change to core.core,
+// which only ever sees the single MultiBackend.
+type MultiBackend struct {
+	endpoints []*endpoint
+}
+
+// NewMultiBackend composes the given backends, in priority order: Send,
+// Broadcast, Verify, Sign and Commit are attempted against the first healthy
+// endpoint first, falling back to the next on error.
+func NewMultiBackend(backends ...Backend) *MultiBackend {
+	endpoints := make([]*endpoint, len(backends))
+	for i, b := range backends {
+		endpoints[i] = newEndpoint(b)
+	}
+	return &MultiBackend{endpoints: endpoints}
+}
+
+// withFailover calls fn against each healthy endpoint in order, recording
+// success/failure per endpoint, and returns the first success. If every
+// endpoint is unhealthy it still tries them all before giving up, so a
+// fully-degraded multi-backend does not wedge forever.
+func (m *MultiBackend) withFailover(fn func(Backend) error) error {
+	var err error
+	tried := false
+	for _, ep := range m.endpoints {
+		if !ep.healthy() {
+			continue
+		}
+		tried = true
+		if err = fn(ep.backend); err == nil {
+			ep.recordSuccess()
+			return nil
+		}
+		ep.recordFailure()
+	}
+	if !tried {
+		// every endpoint is backing off; make a last-ditch pass so a
+		// transient network blip doesn't stall consensus indefinitely.
+		for _, ep := range m.endpoints {
+			if err = fn(ep.backend); err == nil {
+				ep.recordSuccess()
+				return nil
+			}
+			ep.recordFailure()
+		}
+		return errAllBackendsUnhealthy
+	}
+	return err
+}
+
+// primary returns the first healthy endpoint's backend, used for methods
+// that only make sense against a single source of truth (Address,
+// Validators, EventMux).
+func (m *MultiBackend) primary() Backend {
+	for _, ep := range m.endpoints {
+		if ep.healthy() {
+			return ep.backend
+		}
+	}
+	return m.endpoints[0].backend
+}
+
+func (m *MultiBackend) Address() common.Address {
+	return m.primary().Address()
+}
+
+func (m *MultiBackend) Validators() ValidatorSet {
+	return m.primary().Validators()
+}
+
+func (m *MultiBackend) EventMux() *event.TypeMux {
+	return m.primary().EventMux()
+}
+
+func (m *MultiBackend) Send(message []byte, target common.Address) error {
+	return m.withFailover(func(b Backend) error { return b.Send(message, target) })
+}
+
+func (m *MultiBackend) Broadcast(message []byte) error {
+	return m.withFailover(func(b Backend) error { return b.Broadcast(message) })
+}
+
+func (m *MultiBackend) UpdateState(state *State) error {
+	return m.withFailover(func(b Backend) error { return b.UpdateState(state) })
+}
+
+func (m *MultiBackend) ViewChanged(needNewProposal bool) error {
+	return m.withFailover(func(b Backend) error { return b.ViewChanged(needNewProposal) })
+}
+
+func (m *MultiBackend) Commit(proposal *Proposal) error {
+	return m.withFailover(func(b Backend) error { return b.Commit(proposal) })
+}
+
+func (m *MultiBackend) Verify(proposal *Proposal) error {
+	return m.withFailover(func(b Backend) error { return b.Verify(proposal) })
+}
+
+func (m *MultiBackend) Sign(data []byte) (sig []byte, err error) {
+	err = m.withFailover(func(b Backend) error {
+		var ferr error
+		sig, ferr = b.Sign(data)
+		return ferr
+	})
+	return sig, err
+}
+
+func (m *MultiBackend) CheckSignature(data []byte, address common.Address, sig []byte) error {
+	return m.primary().CheckSignature(data, address, sig)
+}
+
+func (m *MultiBackend) CheckValidatorSignature(data []byte, sig []byte) (common.Address, error) {
+	return m.primary().CheckValidatorSignature(data, sig)
+}
+
+func (m *MultiBackend) IsProposer() bool {
+	return m.primary().IsProposer()
+}
+
+func (m *MultiBackend) Hash(b interface{}) common.Hash {
+	return m.primary().Hash(b)
+}
+
+func (m *MultiBackend) Encode(b interface{}) ([]byte, error) {
+	return m.primary().Encode(b)
+}
+
+func (m *MultiBackend) Decode(data []byte, b interface{}) error {
+	return m.primary().Decode(data, b)
+}
+
+func (m *MultiBackend) NewRequest(request RequestContexter) {
+	m.primary().NewRequest(request)
+}
+
+func (m *MultiBackend) Save(key string, val interface{}) error {
+	return m.withFailover(func(b Backend) error { return b.Save(key, val) })
+}
+
+func (m *MultiBackend) Restore(key string, val interface{}) error {
+	return m.withFailover(func(b Backend) error { return b.Restore(key, val) })
+}
+
+// LazyBackend defers dialing the underlying Backend until the first method
+// call that actually needs it, so composing a MultiBackend out of several
+// LazyBackends does not eagerly connect to every endpoint on startup.
+type LazyBackend struct {
+	dial func() (Backend, error)
+
+	mu      sync.Mutex
+	backend Backend
+	dialErr error
+}
+
+// NewLazyBackend wraps a dial function that constructs the real Backend on
+// first use.
+func NewLazyBackend(dial func() (Backend, error)) *LazyBackend {
+	return &LazyBackend{dial: dial}
+}
+
+func (l *LazyBackend) resolve() (Backend, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backend == nil && l.dialErr == nil {
+		l.backend, l.dialErr = l.dial()
+	}
+	return l.backend, l.dialErr
+}
+
+func (l *LazyBackend) Address() common.Address {
+	b, err := l.resolve()
+	if err != nil {
+		return common.Address{}
+	}
+	return b.Address()
+}
+
+func (l *LazyBackend) Validators() ValidatorSet {
+	b, err := l.resolve()
+	if err != nil {
+		return nil
+	}
+	return b.Validators()
+}
+
+func (l *LazyBackend) EventMux() *event.TypeMux {
+	b, err := l.resolve()
+	if err != nil {
+		return nil
+	}
+	return b.EventMux()
+}
+
+func (l *LazyBackend) Send(message []byte, target common.Address) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Send(message, target)
+}
+
+func (l *LazyBackend) Broadcast(message []byte) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Broadcast(message)
+}
+
+func (l *LazyBackend) UpdateState(state *State) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.UpdateState(state)
+}
+
+func (l *LazyBackend) ViewChanged(needNewProposal bool) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.ViewChanged(needNewProposal)
+}
+
+func (l *LazyBackend) Commit(proposal *Proposal) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Commit(proposal)
+}
+
+func (l *LazyBackend) Verify(proposal *Proposal) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Verify(proposal)
+}
+
+func (l *LazyBackend) Sign(data []byte) ([]byte, error) {
+	b, err := l.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return b.Sign(data)
+}
+
+func (l *LazyBackend) CheckSignature(data []byte, address common.Address, sig []byte) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.CheckSignature(data, address, sig)
+}
+
+func (l *LazyBackend) CheckValidatorSignature(data []byte, sig []byte) (common.Address, error) {
+	b, err := l.resolve()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return b.CheckValidatorSignature(data, sig)
+}
+
+func (l *LazyBackend) IsProposer() bool {
+	b, err := l.resolve()
+	if err != nil {
+		return false
+	}
+	return b.IsProposer()
+}
+
+func (l *LazyBackend) Hash(b interface{}) common.Hash {
+	backend, err := l.resolve()
+	if err != nil {
+		return common.Hash{}
+	}
+	return backend.Hash(b)
+}
+
+func (l *LazyBackend) Encode(b interface{}) ([]byte, error) {
+	backend, err := l.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Encode(b)
+}
+
+func (l *LazyBackend) Decode(data []byte, b interface{}) error {
+	backend, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return backend.Decode(data, b)
+}
+
+func (l *LazyBackend) NewRequest(request RequestContexter) {
+	if b, err := l.resolve(); err == nil {
+		b.NewRequest(request)
+	}
+}
+
+func (l *LazyBackend) Save(key string, val interface{}) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Save(key, val)
+}
+
+func (l *LazyBackend) Restore(key string, val interface{}) error {
+	b, err := l.resolve()
+	if err != nil {
+		return err
+	}
+	return b.Restore(key, val)
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pbft
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// flakyBackend fails its first failuresLeft calls to Broadcast, then starts
+// succeeding, simulating a transient network partition against one endpoint.
+type flakyBackend struct {
+	Backend
+	failuresLeft int
+	broadcasts   int
+}
+
+func (f *flakyBackend) Broadcast(message []byte) error {
+	f.broadcasts++
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		return errors.New("transient send failure")
+	}
+	return nil
+}
+
+// stubBackend is a minimal Backend whose methods never fail, used as the
+// healthy half of the composed MultiBackend.
+type stubBackend struct {
+	events *event.TypeMux
+}
+
+func (s *stubBackend) Address() common.Address                          { return common.Address{} }
+func (s *stubBackend) Validators() ValidatorSet                         { return nil }
+func (s *stubBackend) EventMux() *event.TypeMux                         { return s.events }
+func (s *stubBackend) Send(message []byte, target common.Address) error { return nil }
+func (s *stubBackend) Broadcast(message []byte) error                   { return nil }
+func (s *stubBackend) UpdateState(state *State) error                   { return nil }
+func (s *stubBackend) ViewChanged(needNewProposal bool) error           { return nil }
+func (s *stubBackend) Commit(proposal *Proposal) error                  { return nil }
+func (s *stubBackend) Verify(proposal *Proposal) error                  { return nil }
+func (s *stubBackend) Sign(data []byte) ([]byte, error)                 { return data, nil }
+func (s *stubBackend) CheckSignature(data []byte, address common.Address, sig []byte) error {
+	return nil
+}
+func (s *stubBackend) CheckValidatorSignature(data []byte, sig []byte) (common.Address, error) {
+	return common.Address{}, nil
+}
+func (s *stubBackend) IsProposer() bool                          { return false }
+func (s *stubBackend) Hash(b interface{}) common.Hash            { return common.Hash{} }
+func (s *stubBackend) Encode(b interface{}) ([]byte, error)      { return nil, nil }
+func (s *stubBackend) Decode(data []byte, b interface{}) error   { return nil }
+func (s *stubBackend) NewRequest(request RequestContexter)       {}
+func (s *stubBackend) Save(key string, val interface{}) error    { return nil }
+func (s *stubBackend) Restore(key string, val interface{}) error { return nil }
+
+// TestMultiBackendFailover injects transient Broadcast failures on one of two
+// composed backends and checks that MultiBackend still gets the message out
+// via the healthy one, without the caller ever observing an error.
+func TestMultiBackendFailover(t *testing.T) {
+	flaky := &flakyBackend{Backend: &stubBackend{events: new(event.TypeMux)}, failuresLeft: 3}
+	healthy := &stubBackend{events: new(event.TypeMux)}
+
+	m := NewMultiBackend(flaky, healthy)
+
+	for i := 0; i < 3; i++ {
+		if err := m.Broadcast([]byte("proposal")); err != nil {
+			t.Fatalf("round %d: Broadcast should have failed over to the healthy backend, got err: %v", i, err)
+		}
+	}
+
+	if flaky.broadcasts == 0 {
+		t.Fatal("expected the flaky backend to have been tried at least once")
+	}
+}
+
+// TestLazyBackendDefersDial checks that a LazyBackend never calls its dial
+// function until a method that needs the underlying Backend is invoked.
+func TestLazyBackendDefersDial(t *testing.T) {
+	dialed := false
+	lb := NewLazyBackend(func() (Backend, error) {
+		dialed = true
+		return &stubBackend{events: new(event.TypeMux)}, nil
+	})
+
+	if dialed {
+		t.Fatal("NewLazyBackend should not dial eagerly")
+	}
+	if lb.IsProposer() {
+		t.Fatal("stubBackend.IsProposer should be false")
+	}
+	if !dialed {
+		t.Fatal("expected dial to fire on first use")
+	}
+}
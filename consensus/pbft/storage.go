@@ -0,0 +1,42 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pbft
+
+// Storage is the minimal key/value persistence contract the consensus
+// engine needs for its write-ahead log. It is deliberately narrow so it can
+// be backed by LevelDB in production and by an in-memory map in tests.
+type Storage interface {
+	Put(key []byte, value []byte) error
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Delete(key []byte) error
+
+	// NewIterator returns an iterator over all keys sharing the given
+	// prefix, ordered by key. The WAL's keys encode sequence, round and
+	// entry kind, so replay follows that order, not the order of appends.
+	NewIterator(prefix []byte) StorageIterator
+
+	Close() error
+}
+
+// StorageIterator walks the key/value pairs under a Storage prefix.
+type StorageIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 AMIS Technologies
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pbft
+
+import (
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDBStorage is the default, on-disk Storage implementation: a thin
+// adapter over the same ethdb.Database handle the rest of the node uses, so
+// the consensus WAL lives in the node's regular data directory.
+type levelDBStorage struct {
+	db ethdb.Database
+}
+
+// NewLevelDBStorage opens (creating if necessary) a LevelDB-backed Storage
+// rooted at path, for use as the default WAL backend.
+func NewLevelDBStorage(path string) (Storage, error) {
+	db, err := ethdb.NewLDBDatabase(path, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBStorage{db: db}, nil
+}
+
+func (s *levelDBStorage) Put(key, value []byte) error    { return s.db.Put(key, value) }
+func (s *levelDBStorage) Get(key []byte) ([]byte, error) { return s.db.Get(key) }
+func (s *levelDBStorage) Has(key []byte) (bool, error)   { return s.db.Has(key) }
+func (s *levelDBStorage) Delete(key []byte) error        { return s.db.Delete(key) }
+func (s *levelDBStorage) Close() error                   { s.db.Close(); return nil }
+
+func (s *levelDBStorage) NewIterator(prefix []byte) StorageIterator {
+	ldb, ok := s.db.(*ethdb.LDBDatabase)
+	if !ok {
+		return &emptyIterator{}
+	}
+	return &levelDBIterator{it: ldb.LDB().NewIterator(util.BytesPrefix(prefix), nil)}
+}
+
+type levelDBIterator struct {
+	it *leveldb.Iterator
+}
+
+func (i *levelDBIterator) Next() bool    { return i.it.Next() }
+func (i *levelDBIterator) Key() []byte   { return i.it.Key() }
+func (i *levelDBIterator) Value() []byte { return i.it.Value() }
+func (i *levelDBIterator) Release()      { i.it.Release() }
+
+type emptyIterator struct{}
+
+func (emptyIterator) Next() bool    { return false }
+func (emptyIterator) Key() []byte   { return nil }
+func (emptyIterator) Value() []byte { return nil }
+func (emptyIterator) Release()      {}